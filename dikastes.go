@@ -18,8 +18,10 @@ import (
 	"context"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 	"fmt"
@@ -30,6 +32,8 @@ import (
 	"github.com/projectcalico/libcalico-go/lib/apiconfig"
 
 	docopt "github.com/docopt/docopt-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	spireauth "github.com/spiffe/spire/pkg/agent/auth"
 	"google.golang.org/grpc"
@@ -52,6 +56,11 @@ Options:
   -c --ca <ca>           Kubernetes CA Cert file [default: /var/run/secrets/kubernetes.io/serviceaccount/ca.crt]
   -t --token <token>     Kubernetes API Token file [default: /var/run/secrets/kubernetes.io/serviceaccount/token]
   --kube <kubeconfig>    Path to kubeconfig.
+  --audit-log <path>     Path to write the JSON decision audit log, or - for stdout. [default: -]
+  --audit-grpc <target>  Stream decisions to a gRPC audit collector at this target, in addition to --audit-log.
+  --metrics-listen <addr>  Address to serve /metrics, /healthz, and /readyz on, e.g. :9081. Disabled if not set.
+  --envoy-api <versions>  Comma-separated ext_authz API versions to serve (v1,v2,v3), or "all". [default: all]
+  --audit-only         Compute and audit policy decisions, but always allow the request.
   --debug             Log at Debug level.`
 const version = "0.1"
 const NODE_NAME_ENV = "K8S_NODENAME"
@@ -99,13 +108,18 @@ func runServer(arguments map[string]interface{}) {
 		log.Fatal("Unable to set write permission on socket.")
 	}
 	gs := grpc.NewServer(grpc.Creds(spireauth.NewCredentials()))
-	ds, err := server.NewServer(getConfig(arguments), getNodeName())
+	audit := getAuditSink(arguments)
+	ds, err := server.NewServer(getConfig(arguments), getNodeName(), audit, arguments["--audit-only"].(bool))
 	if err != nil {
 		log.Fatalf("Unable to start server %v", err)
 	}
-	authz.RegisterAuthorizationServer(gs, ds)
+	server.RegisterAuthzServers(gs, ds, strings.Split(arguments["--envoy-api"].(string), ","))
 	reflection.Register(gs)
 
+	if addr, ok := arguments["--metrics-listen"].(string); ok && addr != "" {
+		go serveMetrics(addr, ds.Query.Ready)
+	}
+
 	// Run gRPC server on separate goroutine so we catch any signals and clean up the socket.
 	go func() {
 		if err := gs.Serve(lis); err != nil {
@@ -122,6 +136,53 @@ func runServer(arguments map[string]interface{}) {
 	log.Infof("Got signal:", s)
 }
 
+// getAuditSink builds the decision-reporting sink(s) selected by the
+// --audit-log, --audit-grpc, and --metrics-listen flags and wraps them in a
+// dispatcher so Check() never blocks on one.
+func getAuditSink(arguments map[string]interface{}) server.AuditSink {
+	var sinks []server.AuditSink
+
+	if path, ok := arguments["--audit-log"].(string); ok && path != "" {
+		sink, err := server.NewJSONAuditSink(path, 100*1024*1024)
+		if err != nil {
+			log.Fatalf("Unable to open audit log %v. %v", path, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	if target, ok := arguments["--audit-grpc"].(string); ok && target != "" {
+		sink, err := server.NewGRPCAuditSink(target)
+		if err != nil {
+			log.Fatalf("Unable to dial audit collector %v. %v", target, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	if addr, ok := arguments["--metrics-listen"].(string); ok && addr != "" {
+		sinks = append(sinks, server.NewPrometheusAuditSink(prometheus.DefaultRegisterer))
+	}
+	return server.NewAuditDispatcher(sinks...)
+}
+
+// serveMetrics runs a small HTTP server exposing Prometheus metrics plus
+// liveness/readiness probes, used by --metrics-listen.
+func serveMetrics(addr string, ready func() bool) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !ready() {
+			http.Error(w, "policy cache not yet synced", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	log.WithField("listen", addr).Info("Serving metrics and health checks.")
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.WithError(err).Error("Metrics server exited.")
+	}
+}
+
 func getNodeName() string {
 	nn, ok := os.LookupEnv(NODE_NAME_ENV)
 	if !ok {
@@ -0,0 +1,20 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package proto holds the generated client/server stubs for audit.proto.
+// audit.pb.go is checked in rather than built by CI; regenerate it after
+// editing audit.proto with:
+//
+//go:generate protoc --go_out=plugins=grpc:. audit.proto
+package proto
@@ -0,0 +1,170 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Decision records the outcome of a single Check() call, with enough
+// context for an audit sink to explain it after the fact.
+type Decision struct {
+	Timestamp       time.Time     `json:"timestamp"`
+	Allowed         bool          `json:"allowed"`
+	PolicyNamespace string        `json:"policyNamespace,omitempty"`
+	PolicyName      string        `json:"policyName,omitempty"`
+	RuleIndex       int           `json:"ruleIndex"`
+	SourceSPIFFEID  string        `json:"sourceSpiffeId,omitempty"`
+	HTTPMethod      string        `json:"httpMethod,omitempty"`
+	HTTPPath        string        `json:"httpPath,omitempty"`
+	HTTPHost        string        `json:"httpHost,omitempty"`
+	Latency         time.Duration `json:"latencyNs"`
+}
+
+// AuditSink receives every decision Check() makes.  Implementations must
+// not block: the dispatcher calls Report from its own goroutine, but a slow
+// sink still delays every other sink behind it on that goroutine.
+type AuditSink interface {
+	Report(d Decision)
+}
+
+// auditQueueLen bounds how many decisions can be buffered waiting for the
+// dispatcher to drain them to each sink.  Once full, new decisions are
+// dropped rather than blocking Check().
+const auditQueueLen = 4096
+
+// auditDispatcher fans decisions out to every configured sink from a single
+// background goroutine, so Check() never waits on a sink.
+type auditDispatcher struct {
+	sinks []AuditSink
+	ch    chan Decision
+}
+
+// NewAuditDispatcher wraps sinks in a dispatcher so callers (e.g. Check())
+// can Report to all of them through one non-blocking call.  With no sinks,
+// decisions are simply dropped.
+func NewAuditDispatcher(sinks ...AuditSink) *auditDispatcher {
+	d := &auditDispatcher{sinks: sinks, ch: make(chan Decision, auditQueueLen)}
+	go d.run()
+	return d
+}
+
+func (d *auditDispatcher) run() {
+	for dec := range d.ch {
+		for _, s := range d.sinks {
+			s.Report(dec)
+		}
+	}
+}
+
+// Report enqueues a decision, dropping it if the queue is full rather than
+// blocking the caller.
+func (d *auditDispatcher) Report(dec Decision) {
+	select {
+	case d.ch <- dec:
+	default:
+		log.Warn("Audit queue full, dropping decision.")
+	}
+}
+
+// noopAuditSink is used when no sinks are configured, so Check() always has
+// something to report to.
+type noopAuditSink struct{}
+
+func (noopAuditSink) Report(Decision) {}
+
+// jsonAuditSink writes one JSON object per line to a file, rotating it once
+// it grows past maxBytes.  Passing path "-" writes to stdout and disables
+// rotation.
+type jsonAuditSink struct {
+	lock     sync.Mutex
+	path     string
+	maxBytes int64
+	w        *os.File
+	size     int64
+}
+
+func NewJSONAuditSink(path string, maxBytes int64) (*jsonAuditSink, error) {
+	s := &jsonAuditSink{path: path, maxBytes: maxBytes}
+	if path == "-" || path == "" {
+		s.w = os.Stdout
+		return s, nil
+	}
+	if err := s.openForAppend(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *jsonAuditSink) openForAppend() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("opening audit log %s: %v", s.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.w = f
+	s.size = info.Size()
+	return nil
+}
+
+func (s *jsonAuditSink) Report(d Decision) {
+	b, err := json.Marshal(d)
+	if err != nil {
+		log.WithError(err).Warn("Failed to marshal audit decision.")
+		return
+	}
+	b = append(b, '\n')
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.w != os.Stdout && s.maxBytes > 0 && s.size+int64(len(b)) > s.maxBytes {
+		if err := s.rotate(); err != nil {
+			log.WithError(err).Warn("Failed to rotate audit log, continuing to write to current file.")
+		}
+	}
+	n, err := s.w.Write(b)
+	if err != nil {
+		log.WithError(err).Warn("Failed to write audit decision.")
+		return
+	}
+	s.size += int64(n)
+}
+
+// rotate renames the current log aside with a ".1" suffix and opens a fresh
+// one.  If either step fails, the current file stays open and in use.
+// Callers must hold s.lock.
+func (s *jsonAuditSink) rotate() error {
+	rotated := s.path + ".1"
+	if err := os.Rename(s.path, rotated); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	old := s.w
+	if err := s.openForAppend(); err != nil {
+		return err
+	}
+	old.Close()
+	s.size = 0
+	return nil
+}
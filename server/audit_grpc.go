@@ -0,0 +1,136 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"sync"
+
+	"github.com/projectcalico/app-policy/proto"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+// grpcAuditQueueLen bounds how many decisions can be buffered waiting for
+// this sink's own goroutine to stream them out. It's separate from
+// auditQueueLen so that a stalled collector fills only this buffer, never
+// the shared auditDispatcher channel every other sink reads from too.
+const grpcAuditQueueLen = 1024
+
+// grpcAuditSink streams decisions to a user-configured collector endpoint.
+// Report never calls stream.Send itself -- it only enqueues onto this
+// sink's own buffered channel, which a dedicated goroutine drains -- so a
+// collector that stops reading stalls this sink's queue, not the
+// dispatcher goroutine other sinks (JSON, Prometheus) share with it.
+//
+// grpc.Dial's connection reconnects on its own, but the Report stream
+// doesn't: once a collector restart or network blip fails a Send, that
+// stream is dead for good. run() redials and re-opens the stream whenever
+// Send fails, so the sink recovers instead of silently dropping every
+// decision for the rest of the process's life.
+type grpcAuditSink struct {
+	target string
+
+	// connMu guards conn and stream, which reconnect replaces. Report only
+	// ever touches ch, so it never needs to take this lock.
+	connMu sync.Mutex
+	conn   *grpc.ClientConn
+	stream proto.AuditCollector_ReportClient
+
+	ch chan Decision
+}
+
+func NewGRPCAuditSink(target string) (*grpcAuditSink, error) {
+	conn, stream, err := dialAuditCollector(target)
+	if err != nil {
+		return nil, err
+	}
+	s := &grpcAuditSink{target: target, conn: conn, stream: stream, ch: make(chan Decision, grpcAuditQueueLen)}
+	go s.run()
+	return s, nil
+}
+
+func dialAuditCollector(target string) (*grpc.ClientConn, proto.AuditCollector_ReportClient, error) {
+	conn, err := grpc.Dial(target, grpc.WithInsecure())
+	if err != nil {
+		return nil, nil, err
+	}
+	stream, err := proto.NewAuditCollectorClient(conn).Report(context.Background())
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, stream, nil
+}
+
+func (s *grpcAuditSink) run() {
+	for d := range s.ch {
+		s.connMu.Lock()
+		err := s.stream.Send(decisionToProto(d))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"target": s.target,
+				"err":    err,
+			}).Warn("Failed to stream decision to audit collector, reconnecting.")
+			s.reconnect()
+		}
+		s.connMu.Unlock()
+	}
+}
+
+// reconnect redials the collector and re-opens the Report stream, replacing
+// the dead ones. It logs and gives up for this call if the redial itself
+// fails -- the next failed Send will simply retry. connMu must be held by
+// the caller.
+func (s *grpcAuditSink) reconnect() {
+	s.conn.Close()
+	conn, stream, err := dialAuditCollector(s.target)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"target": s.target,
+			"err":    err,
+		}).Warn("Failed to reconnect to audit collector.")
+		return
+	}
+	s.conn = conn
+	s.stream = stream
+}
+
+// Report enqueues a decision for this sink's own goroutine, dropping it if
+// that goroutine is behind, rather than blocking the caller (the shared
+// auditDispatcher goroutine).
+func (s *grpcAuditSink) Report(d Decision) {
+	select {
+	case s.ch <- d:
+	default:
+		log.WithField("target", s.target).Warn("Audit gRPC queue full, dropping decision.")
+	}
+}
+
+func decisionToProto(d Decision) *proto.Decision {
+	return &proto.Decision{
+		Allowed:         d.Allowed,
+		PolicyNamespace: d.PolicyNamespace,
+		PolicyName:      d.PolicyName,
+		RuleIndex:       int32(d.RuleIndex),
+		SourceSpiffeId:  d.SourceSPIFFEID,
+		HttpMethod:      d.HTTPMethod,
+		HttpPath:        d.HTTPPath,
+		HttpHost:        d.HTTPHost,
+		LatencyMs:       d.Latency.Milliseconds(),
+		TimestampUnix:   d.Timestamp.Unix(),
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// prometheusAuditSink records every decision as Prometheus counters and a
+// latency histogram.  Registration happens once, in NewPrometheusAuditSink;
+// Report only ever touches the already-registered collectors.
+type prometheusAuditSink struct {
+	checkTotal   *prometheus.CounterVec
+	checkLatency prometheus.Histogram
+}
+
+func NewPrometheusAuditSink(reg prometheus.Registerer) *prometheusAuditSink {
+	s := &prometheusAuditSink{
+		checkTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dikastes_check_total",
+			Help: "Total number of ext_authz Check requests, by decision, matched policy, and namespace.",
+		}, []string{"decision", "policy", "namespace"}),
+		checkLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "dikastes_check_latency_seconds",
+			Help:    "Latency of ext_authz Check requests in seconds.",
+			Buckets: prometheus.DefBuckets,
+		}),
+	}
+	reg.MustRegister(s.checkTotal, s.checkLatency)
+	return s
+}
+
+func (s *prometheusAuditSink) Report(d Decision) {
+	decision := "deny"
+	if d.Allowed {
+		decision = "allow"
+	}
+	s.checkTotal.WithLabelValues(decision, d.PolicyName, d.PolicyNamespace).Inc()
+	s.checkLatency.Observe(d.Latency.Seconds())
+}
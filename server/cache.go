@@ -0,0 +1,174 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+)
+
+// endpointKey identifies a WorkloadEndpoint by namespace and name, the same
+// way the rest of this package keys policies and service accounts. podKeys
+// (namespace + pod name) reuse the same type, since a pod and the
+// WorkloadEndpoint Calico's CNI plugin creates for it share a namespace and
+// are just as uniquely identified by name.
+type endpointKey struct {
+	Namespace string
+	Name      string
+}
+
+// endpointCache holds, for every local WorkloadEndpoint we've seen, the
+// tier- and order-sorted list of PolicyRules that apply to it, plus the
+// container-ID index Check() resolves a request's container against. The
+// rule set is recomputed whenever a watch event touches a policy, endpoint,
+// or one of the resources a policy selector can reference, so that Check()
+// never needs to talk to the API server.
+//
+// The container-ID index is built from Pod events (a WorkloadEndpoint
+// doesn't carry a container ID itself), joined to the WorkloadEndpoint by
+// pod name/namespace. Both halves of that join are tracked so that either
+// an endpoint deletion or a pod deletion can unwind exactly the container
+// mapping it owns, instead of leaking an entry for every endpoint or pod
+// that's ever existed on the node.
+//
+// It is safe for concurrent use: reflectors populate it from their own
+// goroutines while Check() reads it from gRPC handler goroutines.
+type endpointCache struct {
+	lock sync.RWMutex
+
+	// rules holds the precomputed, ordered rule set for each endpoint.
+	rules map[endpointKey][]PolicyRule
+
+	// containers maps a container ID to the endpoint that currently owns
+	// it, so Check() can resolve a container ID without a live query.
+	containers map[string]endpointKey
+
+	// endpointPod and podEndpoint are the two directions of the
+	// endpoint<->pod join: endpointPod lets deleteEndpoint find the pod
+	// key it needs to clean up after itself; podEndpoint lets a Pod event
+	// find the endpoint (if any) whose container entry it should update.
+	endpointPod map[endpointKey]endpointKey
+	podEndpoint map[endpointKey]endpointKey
+
+	// podContainer holds the latest container ID observed for each pod,
+	// independent of whether it's been joined to an endpoint yet.
+	podContainer map[endpointKey]string
+
+	// tierOrder caches each known Tier's Spec.Order, keyed by tier name,
+	// so sortPolicyRules can order by Calico's real tier evaluation order
+	// instead of the tier's name.
+	tierOrder map[string]float64
+}
+
+func newEndpointCache() *endpointCache {
+	return &endpointCache{
+		rules:        make(map[endpointKey][]PolicyRule),
+		containers:   make(map[string]endpointKey),
+		endpointPod:  make(map[endpointKey]endpointKey),
+		podEndpoint:  make(map[endpointKey]endpointKey),
+		podContainer: make(map[endpointKey]string),
+		tierOrder:    make(map[string]float64),
+	}
+}
+
+func (c *endpointCache) getRules(key endpointKey) ([]PolicyRule, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	rules, ok := c.rules[key]
+	return rules, ok
+}
+
+// setEndpoint records the rule set and pod identity for a live endpoint. If
+// a container ID has already been observed for that pod (via
+// setPodContainer), the container index is pointed at this endpoint too.
+func (c *endpointCache) setEndpoint(key, podKey endpointKey, rules []PolicyRule) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.rules[key] = rules
+	c.endpointPod[key] = podKey
+	c.podEndpoint[podKey] = key
+	if cid, ok := c.podContainer[podKey]; ok {
+		c.containers[cid] = key
+	}
+}
+
+// deleteEndpoint removes everything the cache knows about a deleted
+// endpoint: its rule set, its pod join, and -- if one was set -- the
+// container-ID entry pointing at it. Without this, both the rules map and
+// the container index would grow without bound across normal pod churn.
+func (c *endpointCache) deleteEndpoint(key endpointKey) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.rules, key)
+	podKey, ok := c.endpointPod[key]
+	if !ok {
+		return
+	}
+	delete(c.endpointPod, key)
+	delete(c.podEndpoint, podKey)
+	if cid, ok := c.podContainer[podKey]; ok {
+		delete(c.containers, cid)
+	}
+}
+
+// setPodContainer records the container ID a Pod event reported for podKey.
+// If that pod already had a different container ID on record (a restart or
+// replacement within the same pod), that old ID's container-index entry is
+// dropped first, so the index doesn't accumulate one stale entry per
+// container restart over the node's lifetime. If the pod is already joined
+// to an endpoint, the container index is updated to point at it.
+func (c *endpointCache) setPodContainer(podKey endpointKey, containerID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if oldCID, ok := c.podContainer[podKey]; ok && oldCID != containerID {
+		delete(c.containers, oldCID)
+	}
+	c.podContainer[podKey] = containerID
+	if key, ok := c.podEndpoint[podKey]; ok {
+		c.containers[containerID] = key
+	}
+}
+
+// deletePod forgets a pod's container ID and, if it was driving a container
+// index entry, removes that entry too.
+func (c *endpointCache) deletePod(podKey endpointKey) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if cid, ok := c.podContainer[podKey]; ok {
+		delete(c.containers, cid)
+	}
+	delete(c.podContainer, podKey)
+}
+
+func (c *endpointCache) getContainer(containerID string) (endpointKey, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	key, ok := c.containers[containerID]
+	return key, ok
+}
+
+// setTierOrder replaces the cached Tier name -> Spec.Order map wholesale;
+// callers rebuild it in full from the Tier indexer on every Tier event.
+func (c *endpointCache) setTierOrder(order map[string]float64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.tierOrder = order
+}
+
+func (c *endpointCache) getTierOrder(tier string) (float64, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	o, ok := c.tierOrder[tier]
+	return o, ok
+}
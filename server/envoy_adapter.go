@@ -0,0 +1,200 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+
+	authz "github.com/envoyproxy/data-plane-api/api/auth"
+	authv2 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	envoytype "github.com/envoyproxy/go-control-plane/envoy/type"
+	envoytypev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+)
+
+// The v1, v2 and v3 Envoy ext_authz wire formats are, field for field,
+// the same request/response shape; only the Go package (and a little
+// nesting) changes between them. Rather than teach matchPolicies/matchHTTP
+// three dialects, we keep the existing v1 authz.CheckRequest/CheckResponse
+// as the internal neutral type and adapt v2/v3 onto it at the edge, so the
+// decision core in server.go and match.go runs exactly once per request no
+// matter which version asked.
+
+// v2Authz adapts envoy.service.auth.v2.Authorization onto auth_server.Check.
+type v2Authz struct{ *auth_server }
+
+// v3Authz adapts envoy.service.auth.v3.Authorization onto auth_server.Check.
+type v3Authz struct{ *auth_server }
+
+func (a v2Authz) Check(ctx context.Context, req *authv2.CheckRequest) (*authv2.CheckResponse, error) {
+	resp, err := a.auth_server.Check(ctx, v2RequestToV1(req))
+	if err != nil {
+		return nil, err
+	}
+	return v1ResponseToV2(resp), nil
+}
+
+func (a v3Authz) Check(ctx context.Context, req *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	resp, err := a.auth_server.Check(ctx, v3RequestToV1(req))
+	if err != nil {
+		return nil, err
+	}
+	return v1ResponseToV3(resp), nil
+}
+
+func v2RequestToV1(req *authv2.CheckRequest) *authz.CheckRequest {
+	attr := req.GetAttributes()
+	src := attr.GetSource()
+	httpReq := attr.GetRequest().GetHttp()
+	return &authz.CheckRequest{
+		Attributes: &authz.AttributeContext{
+			Source: &authz.AttributeContext_Peer{
+				Principal: src.GetPrincipal(),
+				Labels:    src.GetLabels(),
+			},
+			Destination: &authz.AttributeContext_Peer{
+				Address: destinationAddress(attr.GetDestination().GetAddress().GetSocketAddress().GetPortValue()),
+			},
+			Request: &authz.AttributeContext_Request{
+				Http: &authz.AttributeContext_HTTPRequest{
+					Method:  httpReq.GetMethod(),
+					Path:    httpReq.GetPath(),
+					Host:    httpReq.GetHost(),
+					Headers: httpReq.GetHeaders(),
+				},
+			},
+		},
+	}
+}
+
+func v3RequestToV1(req *authv3.CheckRequest) *authz.CheckRequest {
+	attr := req.GetAttributes()
+	src := attr.GetSource()
+	httpReq := attr.GetRequest().GetHttp()
+	return &authz.CheckRequest{
+		Attributes: &authz.AttributeContext{
+			Source: &authz.AttributeContext_Peer{
+				Principal: src.GetPrincipal(),
+				Labels:    src.GetLabels(),
+			},
+			Destination: &authz.AttributeContext_Peer{
+				Address: destinationAddress(attr.GetDestination().GetAddress().GetSocketAddress().GetPortValue()),
+			},
+			Request: &authz.AttributeContext_Request{
+				Http: &authz.AttributeContext_HTTPRequest{
+					Method:  httpReq.GetMethod(),
+					Path:    httpReq.GetPath(),
+					Host:    httpReq.GetHost(),
+					Headers: httpReq.GetHeaders(),
+				},
+			},
+		},
+	}
+}
+
+func destinationAddress(port uint32) *authz.Address {
+	if port == 0 {
+		return nil
+	}
+	return &authz.Address{
+		Address: &authz.Address_SocketAddress{
+			SocketAddress: &authz.SocketAddress{
+				PortSpecifier: &authz.SocketAddress_PortValue{PortValue: port},
+			},
+		},
+	}
+}
+
+// deniedHTTPStatus maps an rpc status code, as set by auth_server.Check, to
+// the HTTP status Envoy should send back downstream on a deny.
+func deniedHTTPStatus(c int32) int32 {
+	switch c {
+	case code.Code_value["PERMISSION_DENIED"]:
+		return 403
+	case code.Code_value["UNAVAILABLE"]:
+		return 503
+	default:
+		return 500
+	}
+}
+
+func v1ResponseToV2(resp *authz.CheckResponse) *authv2.CheckResponse {
+	st := resp.GetStatus()
+	out := &authv2.CheckResponse{Status: st}
+	if st.GetCode() == code.Code_value["OK"] {
+		out.HttpResponse = &authv2.CheckResponse_OkResponse{OkResponse: &authv2.OkHttpResponse{}}
+		return out
+	}
+	out.HttpResponse = &authv2.CheckResponse_DeniedResponse{DeniedResponse: &authv2.DeniedHttpResponse{
+		Status: &envoytype.HttpStatus{Code: envoytype.StatusCode(deniedHTTPStatus(st.GetCode()))},
+		Body:   denialBody(st),
+	}}
+	return out
+}
+
+func v1ResponseToV3(resp *authz.CheckResponse) *authv3.CheckResponse {
+	st := resp.GetStatus()
+	out := &authv3.CheckResponse{Status: st}
+	if st.GetCode() == code.Code_value["OK"] {
+		out.HttpResponse = &authv3.CheckResponse_OkResponse{OkResponse: &authv3.OkHttpResponse{}}
+		return out
+	}
+	out.HttpResponse = &authv3.CheckResponse_DeniedResponse{DeniedResponse: &authv3.DeniedHttpResponse{
+		Status: &envoytypev3.HttpStatus{Code: envoytypev3.StatusCode(deniedHTTPStatus(st.GetCode()))},
+		Body:   denialBody(st),
+	}}
+	return out
+}
+
+func denialBody(st *status.Status) string {
+	if st.GetMessage() != "" {
+		return st.GetMessage()
+	}
+	return fmt.Sprintf("request denied by policy (%s)", code.Code_name[st.GetCode()])
+}
+
+// RegisterAuthzServers registers the v1 Authorization service and the v2
+// and v3 envoy.service.auth Authorization services on gs, all backed by the
+// same auth_server.Check. apis controls which of them are enabled ("v1",
+// "v2", "v3"); "all" (the default) enables every version.
+func RegisterAuthzServers(gs *grpc.Server, as *auth_server, apis []string) {
+	enabled := map[string]bool{}
+	for _, a := range apis {
+		if a == "all" {
+			enabled["v1"], enabled["v2"], enabled["v3"] = true, true, true
+			break
+		}
+		enabled[a] = true
+	}
+
+	if enabled["v1"] {
+		authz.RegisterAuthorizationServer(gs, as)
+		log.Info("Registered Envoy ext_authz v1 service.")
+	}
+	if enabled["v2"] {
+		authv2.RegisterAuthorizationServer(gs, v2Authz{as})
+		log.Info("Registered Envoy ext_authz v2 service.")
+	}
+	if enabled["v3"] {
+		authv3.RegisterAuthorizationServer(gs, v3Authz{as})
+		log.Info("Registered Envoy ext_authz v3 service.")
+	}
+}
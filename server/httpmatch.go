@@ -0,0 +1,84 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// httpMatchAnnotation is a policy annotation carrying the path, header,
+// host and port match constraints that api.HTTPRule can't express yet:
+// it's a JSON array of *HTTPMatch, one entry per Spec.Ingress rule by
+// index (a null entry, or a short array, means "no extra constraints" for
+// that rule). It's a stopgap until those fields land in the Calico API
+// proper; once they do, this annotation and HTTPMatch go away and match.go
+// reads straight off api.HTTPRule instead.
+const httpMatchAnnotation = "policy.tigera.io/http-match"
+
+// HTTPMatch carries the HTTP match constraints rule.HTTP can't express
+// today. PathMatch and HeaderMatch mirror the match semantics api.HTTPPath
+// and api.HTTPHeaderMatch use elsewhere in the Calico API.
+type HTTPMatch struct {
+	Paths      []PathMatch   `json:"paths,omitempty"`
+	NotPaths   []PathMatch   `json:"notPaths,omitempty"`
+	Headers    []HeaderMatch `json:"headers,omitempty"`
+	NotHeaders []HeaderMatch `json:"notHeaders,omitempty"`
+	Hosts      []string      `json:"hosts,omitempty"`
+	Ports      []uint16      `json:"ports,omitempty"`
+}
+
+// PathMatch matches a request path by exactly one of Exact, Prefix or Regex.
+type PathMatch struct {
+	Exact  string `json:"exact,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+	Regex  string `json:"regex,omitempty"`
+}
+
+// HeaderMatch matches a named request header. A bare Name with no
+// Exact/Regex just asserts the header's presence.
+type HeaderMatch struct {
+	Name       string `json:"name"`
+	Exact      string `json:"exact,omitempty"`
+	Regex      string `json:"regex,omitempty"`
+	IgnoreCase bool   `json:"ignoreCase,omitempty"`
+}
+
+// parseHTTPMatches unmarshals httpMatchAnnotation, if present. A missing or
+// malformed annotation returns nil rather than an error: the API server
+// never validates this annotation's contents, so a bad one should degrade
+// to "no extra HTTP constraints" rather than stopping policy evaluation.
+func parseHTTPMatches(annotations map[string]string) []*HTTPMatch {
+	raw, ok := annotations[httpMatchAnnotation]
+	if !ok {
+		return nil
+	}
+	var matches []*HTTPMatch
+	if err := json.Unmarshal([]byte(raw), &matches); err != nil {
+		log.Warnf("Could not parse %s annotation: %v", httpMatchAnnotation, err)
+		return nil
+	}
+	return matches
+}
+
+// httpMatchForRule returns the HTTPMatch for the ingress rule at ruleIndex,
+// or nil if the annotation didn't cover that index.
+func httpMatchForRule(matches []*HTTPMatch, ruleIndex int) *HTTPMatch {
+	if ruleIndex < len(matches) {
+		return matches[ruleIndex]
+	}
+	return nil
+}
@@ -17,6 +17,8 @@ package server
 import (
 	"fmt"
 	"regexp"
+	"strings"
+	"sync"
 
 	authz "github.com/envoyproxy/data-plane-api/api/auth"
 
@@ -30,22 +32,40 @@ const SPIFFE_ID_PATTERN = "^spiffe://[^/]+/ns/([^/]+)/sa/([^/]+)$"
 
 var spiffeIdRegExp *regexp.Regexp
 
-// match checks if the Rule matches the request.  It returns true if the Rule matches, false otherwise.
-func match(rule api.Rule, req *authz.CheckRequest) bool {
-	log.Debugf("Checking rule %v on request %v", rule, req)
+// regexCache holds regexes compiled from rule fields, keyed by pattern, so a
+// rule's path/header regexes are only compiled once no matter how many
+// requests it's evaluated against.
+var regexCache sync.Map // map[string]*regexp.Regexp
+
+func compileRegex(pattern string) (*regexp.Regexp, error) {
+	if cached, ok := regexCache.Load(pattern); ok {
+		return cached.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	regexCache.Store(pattern, re)
+	return re, nil
+}
+
+// match checks if pr's Rule matches the request.  It returns true if the Rule matches, false otherwise.
+func match(pr *PolicyRule, req *authz.CheckRequest) bool {
+	log.Debugf("Checking rule %v on request %v", pr.Rule, req)
 	attr := req.GetAttributes()
-	return matchPeer(rule.Source, attr.GetSource()) && matchRequest(rule, attr.GetRequest())
+	return matchPeer(pr.Rule.Source, attr.GetSource()) && matchRequest(pr, attr)
 }
 
 func matchPeer(er api.EntityRule, peer *authz.AttributeContext_Peer) bool {
 	return matchServiceAccounts(er.ServiceAccounts, peer)
 }
 
-func matchRequest(rule api.Rule, req *authz.AttributeContext_Request) bool {
+func matchRequest(pr *PolicyRule, attr *authz.AttributeContext) bool {
+	req := attr.GetRequest()
 	log.WithFields(log.Fields{
 		"request": req,
 	}).Debug("Matching request.")
-	return matchHTTP(rule.HTTP, req.GetHttp())
+	return matchHTTP(pr.Rule.HTTP, pr.HTTPMatch, req.GetHttp(), attr.GetDestination())
 }
 
 func matchServiceAccounts(saMatch *api.ServiceAccountMatch, peer *authz.AttributeContext_Peer) bool {
@@ -125,15 +145,39 @@ func matchServiceAccountLabels(selectorStr string, labels map[string]string) boo
 
 }
 
-func matchHTTP(rule *api.HTTPRule, req *authz.AttributeContext_HTTPRequest) bool {
+// matchHTTP matches a request against the two sources of HTTP constraints a
+// rule can carry: rule.Methods, the one field the upstream HTTPRule schema
+// already supports, and httpMatch's path/header/host/port constraints,
+// which are sourced from httpMatchAnnotation until they land in that schema
+// (see HTTPMatch). Either may be nil, meaning "no constraint of that kind".
+func matchHTTP(rule *api.HTTPRule, httpMatch *HTTPMatch, req *authz.AttributeContext_HTTPRequest, dst *authz.AttributeContext_Peer) bool {
 	log.WithFields(log.Fields{
-		"rule": rule,
+		"rule":      rule,
+		"httpMatch": httpMatch,
 	}).Debug("Matching HTTP.")
-	if rule == nil {
-		log.Debug("nil HTTPRule.  Return true")
+	if rule == nil && httpMatch == nil {
+		log.Debug("nil HTTPRule and HTTPMatch.  Return true")
 		return true
 	}
-	return matchHTTPMethods(rule.Methods, req.GetMethod())
+	var methods []string
+	if rule != nil {
+		methods = rule.Methods
+	}
+	var paths, notPaths []PathMatch
+	var headers, notHeaders []HeaderMatch
+	var hosts []string
+	var ports []uint16
+	if httpMatch != nil {
+		paths, notPaths = httpMatch.Paths, httpMatch.NotPaths
+		headers, notHeaders = httpMatch.Headers, httpMatch.NotHeaders
+		hosts = httpMatch.Hosts
+		ports = httpMatch.Ports
+	}
+	return matchHTTPMethods(methods, req.GetMethod()) &&
+		matchHTTPPath(paths, notPaths, req.GetPath()) &&
+		matchHTTPHeaders(headers, notHeaders, req.GetHeaders()) &&
+		matchHTTPHost(hosts, req.GetHost()) &&
+		matchHTTPPort(ports, dst)
 }
 
 func matchHTTPMethods(methods []string, reqMethod string) bool {
@@ -158,3 +202,174 @@ func matchHTTPMethods(methods []string, reqMethod string) bool {
 	log.Debug("HTTP Method not matched.")
 	return false
 }
+
+// matchHTTPPath checks the request path against a rule's positive and
+// negative path matchers.  A positive matcher must match (or be absent,
+// meaning "match all"); a negative matcher, if it matches, vetoes the rule
+// regardless of what the positive matchers say.
+func matchHTTPPath(paths, notPaths []PathMatch, reqPath string) bool {
+	log.WithFields(log.Fields{
+		"paths":    paths,
+		"notPaths": notPaths,
+		"reqPath":  reqPath,
+	}).Debug("Matching HTTP Path")
+	for _, p := range notPaths {
+		if matchHTTPPathOne(p, reqPath) {
+			log.Debug("HTTP Path matched a notPaths entry, not matched.")
+			return false
+		}
+	}
+	if len(paths) == 0 {
+		log.Debug("Rule has 0 HTTP Paths, matched.")
+		return true
+	}
+	for _, p := range paths {
+		if matchHTTPPathOne(p, reqPath) {
+			log.Debug("HTTP Path matched.")
+			return true
+		}
+	}
+	log.Debug("HTTP Path not matched.")
+	return false
+}
+
+func matchHTTPPathOne(p PathMatch, reqPath string) bool {
+	// Rules may match on the path only, ignoring any query string.
+	if i := strings.IndexByte(reqPath, '?'); i >= 0 {
+		reqPath = reqPath[:i]
+	}
+	switch {
+	case p.Exact != "":
+		return p.Exact == reqPath
+	case p.Prefix != "":
+		return strings.HasPrefix(reqPath, p.Prefix)
+	case p.Regex != "":
+		re, err := compileRegex(p.Regex)
+		if err != nil {
+			log.Warnf("Could not compile path regex %v, %v", p.Regex, err)
+			return false
+		}
+		return re.MatchString(reqPath)
+	}
+	return false
+}
+
+// matchHTTPHeaders checks the request headers against a rule's positive and
+// negative header matchers, following the same veto semantics as
+// matchHTTPPath.
+func matchHTTPHeaders(headers, notHeaders []HeaderMatch, reqHeaders map[string]string) bool {
+	log.WithFields(log.Fields{
+		"headers":    headers,
+		"notHeaders": notHeaders,
+		"reqHeaders": reqHeaders,
+	}).Debug("Matching HTTP Headers")
+	for _, h := range notHeaders {
+		if matchHTTPHeaderOne(h, reqHeaders) {
+			log.Debug("HTTP Headers matched a notHeaders entry, not matched.")
+			return false
+		}
+	}
+	if len(headers) == 0 {
+		log.Debug("Rule has 0 HTTP Headers, matched.")
+		return true
+	}
+	for _, h := range headers {
+		if matchHTTPHeaderOne(h, reqHeaders) {
+			log.Debug("HTTP Headers matched.")
+			return true
+		}
+	}
+	log.Debug("HTTP Headers not matched.")
+	return false
+}
+
+func matchHTTPHeaderOne(h HeaderMatch, reqHeaders map[string]string) bool {
+	name := h.Name
+	var value string
+	var ok bool
+	if h.IgnoreCase {
+		for k, v := range reqHeaders {
+			if strings.EqualFold(k, name) {
+				value, ok = v, true
+				break
+			}
+		}
+	} else {
+		value, ok = reqHeaders[name]
+	}
+	if !ok {
+		return false
+	}
+	switch {
+	case h.Exact != "":
+		return h.Exact == value
+	case h.Regex != "":
+		re, err := compileRegex(h.Regex)
+		if err != nil {
+			log.Warnf("Could not compile header regex %v, %v", h.Regex, err)
+			return false
+		}
+		return re.MatchString(value)
+	}
+	// A header matcher with no Exact/Regex just asserts presence.
+	return true
+}
+
+// matchHTTPHost checks the `:authority`/Host header against the rule's
+// hosts.  A leading "*." wildcard prefix matches any subdomain, e.g.
+// "*.example.com" matches "foo.example.com" but not "example.com" itself.
+func matchHTTPHost(hosts []string, reqHost string) bool {
+	log.WithFields(log.Fields{
+		"hosts":   hosts,
+		"reqHost": reqHost,
+	}).Debug("Matching HTTP Host")
+	if len(hosts) == 0 {
+		log.Debug("Rule has 0 HTTP Hosts, matched.")
+		return true
+	}
+	// Strip any port suffix before comparing, since rules match on
+	// hostname rather than hostname:port.
+	reqHost = strings.SplitN(reqHost, ":", 2)[0]
+	for _, host := range hosts {
+		if strings.HasPrefix(host, "*.") {
+			suffix := host[1:] // keep the leading dot
+			if strings.HasSuffix(reqHost, suffix) && reqHost != suffix[1:] {
+				log.Debug("HTTP Host matched wildcard.")
+				return true
+			}
+			continue
+		}
+		if host == reqHost {
+			log.Debug("HTTP Host matched.")
+			return true
+		}
+	}
+	log.Debug("HTTP Host not matched.")
+	return false
+}
+
+// matchHTTPPort checks the request's destination port against the rule's
+// allowed ports.
+func matchHTTPPort(ports []uint16, dst *authz.AttributeContext_Peer) bool {
+	if len(ports) == 0 {
+		log.Debug("Rule has 0 HTTP Ports, matched.")
+		return true
+	}
+	reqPort := destinationPort(dst)
+	for _, port := range ports {
+		if port == reqPort {
+			log.Debug("HTTP Port matched.")
+			return true
+		}
+	}
+	log.Debug("HTTP Port not matched.")
+	return false
+}
+
+func destinationPort(dst *authz.AttributeContext_Peer) uint16 {
+	socketAddr := dst.GetAddress().GetSocketAddress()
+	if socketAddr == nil {
+		return 0
+	}
+	return uint16(socketAddr.GetPortValue())
+}
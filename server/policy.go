@@ -0,0 +1,152 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sort"
+
+	authz "github.com/envoyproxy/data-plane-api/api/auth"
+	api "github.com/projectcalico/libcalico-go/lib/apis/v3"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/genproto/googleapis/rpc/status"
+)
+
+// defaultTier is the name Calico gives policies that don't set Spec.Tier.
+const defaultTier = "default"
+
+// PolicyRule pairs a single ingress Rule with the identity and position of
+// the policy it came from, so checkPolicies can evaluate tiers and order,
+// and so audit records can say which policy/rule decided a request.
+// query.go builds and sorts a []PolicyRule per endpoint whenever the
+// caches change; Check() never sorts or looks up a policy itself.
+//
+// TierOrder is the evaluating Tier resource's Spec.Order, not the tier's
+// name: Calico evaluates tiers by that field, so a tier's name has no
+// bearing on where it falls in the evaluation order.
+type PolicyRule struct {
+	Tier            string
+	TierOrder       float64
+	Order           float64
+	PolicyNamespace string
+	PolicyName      string
+	RuleIndex       int
+	Rule            api.Rule
+
+	// HTTPMatch carries this rule's path/header/host/port constraints,
+	// parsed from the policy's httpMatchAnnotation: rule.HTTP can't
+	// express them yet, so they can't live on Rule itself. Nil means the
+	// rule has none.
+	HTTPMatch *HTTPMatch
+}
+
+// sortPolicyRules orders rules the way Calico evaluates them: by tier order
+// (the tier's Spec.Order, queried separately and attached to each rule as
+// TierOrder), then by tier name so tiers sharing an order stay contiguous,
+// then by policy order within the tier, then by policy name as a
+// tie-breaker so the result is deterministic. The implicit default
+// tier always evaluates last, after every explicitly ordered tier,
+// regardless of what TierOrder a Tier resource happens to claim for it.
+// Within a single policy, rule order (RuleIndex) is preserved as-is.
+func sortPolicyRules(rules []PolicyRule) {
+	sort.SliceStable(rules, func(i, j int) bool {
+		a, b := rules[i], rules[j]
+		if a.TierOrder != b.TierOrder {
+			return a.TierOrder < b.TierOrder
+		}
+		if a.Tier != b.Tier {
+			return a.Tier < b.Tier
+		}
+		if a.Order != b.Order {
+			return a.Order < b.Order
+		}
+		if a.PolicyName != b.PolicyName {
+			return a.PolicyName < b.PolicyName
+		}
+		return a.RuleIndex < b.RuleIndex
+	})
+}
+
+// checkPolicies evaluates an endpoint's tiered rule set against req and
+// returns the resulting status, along with the PolicyRule that decided it
+// (nil if no rule decided it, i.e. the default-deny or default-allow
+// below applied).
+//
+// Evaluation follows Calico's tiered model: rules are evaluated in the
+// order query.go sorted them in (tier, then policy order); the first rule
+// that matches the request decides it, except Pass, which stops
+// evaluation of the current tier and falls through to the next one as if
+// the tier had not matched at all. If any policy in any tier selects the
+// endpoint and no rule matches, the request is denied (default-deny); if
+// no policy at all selects the endpoint, it's allowed. Only rules in the
+// slice count: a policy that selects the endpoint but has no ingress rules
+// contributes nothing to it, so on its own it does not cause a deny.
+func checkPolicies(rules []PolicyRule, req *authz.CheckRequest) (status.Status, *PolicyRule) {
+	var sawPolicy bool
+	var tier string
+	tierHasPass := false
+
+	for i := range rules {
+		pr := &rules[i]
+		if pr.Tier != tier {
+			tier = pr.Tier
+			tierHasPass = false
+		}
+		sawPolicy = true
+		if tierHasPass {
+			// Already passed out of this tier; skip its remaining rules.
+			continue
+		}
+		if !match(pr, req) {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"tier":   pr.Tier,
+			"policy": pr.PolicyName,
+			"rule":   pr.RuleIndex,
+			"action": pr.Rule.Action,
+		}).Debug("Rule matched request.")
+		switch pr.Rule.Action {
+		case api.Allow:
+			return okStatus(), pr
+		case api.Deny:
+			return deniedStatus(), pr
+		case api.Log:
+			// Log rules never decide the request; keep evaluating the
+			// rest of the tier as if this rule hadn't matched.
+			continue
+		case api.Pass:
+			tierHasPass = true
+			continue
+		}
+	}
+
+	if sawPolicy {
+		// At least one policy selected this endpoint but none of its
+		// rules (across every tier) decided the request: default-deny.
+		return deniedStatus(), nil
+	}
+	// No policy at all selects this endpoint: default-allow.
+	return okStatus(), nil
+}
+
+func okStatus() status.Status {
+	return status.Status{Code: code.Code_value["OK"]}
+}
+
+func deniedStatus() status.Status {
+	return status.Status{Code: code.Code_value["PERMISSION_DENIED"], Message: "request denied by policy"}
+}
@@ -0,0 +1,197 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"math"
+	"testing"
+
+	authz "github.com/envoyproxy/data-plane-api/api/auth"
+	api "github.com/projectcalico/libcalico-go/lib/apis/v3"
+
+	"google.golang.org/genproto/googleapis/rpc/code"
+)
+
+// testRequest builds a request that every matchAll rule below will match:
+// a valid SPIFFE source principal and no Source/HTTP constraints.
+func testRequest() *authz.CheckRequest {
+	return &authz.CheckRequest{
+		Attributes: &authz.AttributeContext{
+			Source: &authz.AttributeContext_Peer{
+				Principal: "spiffe://cluster.local/ns/default/sa/client",
+			},
+		},
+	}
+}
+
+// matchAllRule builds a PolicyRule with the TierOrder a real recompute()
+// would have attached to a policy in an unnamed (and so never-explicitly-
+// ordered) non-default tier, or math.Inf(1) for the implicit default tier,
+// matching calicoQuery.tierOrder. Tests that care about tier evaluation
+// order across multiple explicitly-ordered tiers use matchAllRuleInTier
+// directly instead.
+func matchAllRule(tier string, order float64, policy string, index int, action api.Action) PolicyRule {
+	tierOrder := math.MaxFloat64
+	if tier == "" || tier == defaultTier {
+		tierOrder = math.Inf(1)
+	}
+	return matchAllRuleInTier(tier, tierOrder, order, policy, index, action)
+}
+
+func matchAllRuleInTier(tier string, tierOrder, order float64, policy string, index int, action api.Action) PolicyRule {
+	return PolicyRule{
+		Tier:            tier,
+		TierOrder:       tierOrder,
+		Order:           order,
+		PolicyNamespace: "default",
+		PolicyName:      policy,
+		RuleIndex:       index,
+		Rule:            api.Rule{Action: action},
+	}
+}
+
+func TestCheckPoliciesDefaultAllowWhenNoPolicySelectsEndpoint(t *testing.T) {
+	st, matched := checkPolicies(nil, testRequest())
+	if st.GetCode() != code.Code_value["OK"] {
+		t.Errorf("expected OK with no policies, got %v", st.GetCode())
+	}
+	if matched != nil {
+		t.Errorf("expected no matched rule, got %+v", matched)
+	}
+}
+
+func TestCheckPoliciesDefaultDenyWhenNoRuleMatches(t *testing.T) {
+	rules := []PolicyRule{
+		{
+			Tier:            defaultTier,
+			PolicyNamespace: "default",
+			PolicyName:      "deny-nothing",
+			RuleIndex:       0,
+			// A Source that can never match: restricts to a service
+			// account name the test request doesn't use.
+			Rule: api.Rule{
+				Action: api.Allow,
+				Source: api.EntityRule{ServiceAccounts: &api.ServiceAccountMatch{Names: []string{"someone-else"}}},
+			},
+		},
+	}
+	st, matched := checkPolicies(rules, testRequest())
+	if st.GetCode() != code.Code_value["PERMISSION_DENIED"] {
+		t.Errorf("expected PERMISSION_DENIED (default-deny), got %v", st.GetCode())
+	}
+	if matched != nil {
+		t.Errorf("expected no matched rule on default-deny, got %+v", matched)
+	}
+}
+
+func TestCheckPoliciesMixedAllowDenyOrdering(t *testing.T) {
+	// A Deny ahead of an Allow in the same tier should win; order within
+	// a tier is the order sortPolicyRules already applied to the slice.
+	rules := []PolicyRule{
+		matchAllRule(defaultTier, 10, "deny-policy", 0, api.Deny),
+		matchAllRule(defaultTier, 20, "allow-policy", 0, api.Allow),
+	}
+	st, matched := checkPolicies(rules, testRequest())
+	if st.GetCode() != code.Code_value["PERMISSION_DENIED"] {
+		t.Errorf("expected PERMISSION_DENIED, got %v", st.GetCode())
+	}
+	if matched == nil || matched.PolicyName != "deny-policy" {
+		t.Errorf("expected deny-policy to have decided the request, got %+v", matched)
+	}
+
+	// Swap the order: Allow first should win instead.
+	rules = []PolicyRule{
+		matchAllRule(defaultTier, 10, "allow-policy", 0, api.Allow),
+		matchAllRule(defaultTier, 20, "deny-policy", 0, api.Deny),
+	}
+	st, matched = checkPolicies(rules, testRequest())
+	if st.GetCode() != code.Code_value["OK"] {
+		t.Errorf("expected OK, got %v", st.GetCode())
+	}
+	if matched == nil || matched.PolicyName != "allow-policy" {
+		t.Errorf("expected allow-policy to have decided the request, got %+v", matched)
+	}
+}
+
+func TestCheckPoliciesTierFallThroughOnPass(t *testing.T) {
+	// "security" tier Passes, so evaluation should fall through to the
+	// "default" tier's Deny, skipping any later rule in "security".
+	rules := []PolicyRule{
+		matchAllRule("security", 10, "pass-policy", 0, api.Pass),
+		matchAllRule("security", 20, "should-be-skipped", 0, api.Deny),
+		matchAllRule(defaultTier, 10, "default-deny", 0, api.Deny),
+	}
+	sortPolicyRules(rules)
+	st, matched := checkPolicies(rules, testRequest())
+	if st.GetCode() != code.Code_value["PERMISSION_DENIED"] {
+		t.Errorf("expected PERMISSION_DENIED from the fall-through tier, got %v", st.GetCode())
+	}
+	if matched == nil || matched.PolicyName != "default-deny" {
+		t.Errorf("expected default-deny to have decided the request after Pass, got %+v", matched)
+	}
+}
+
+func TestSortPolicyRulesOrdersTiersThenOrderThenName(t *testing.T) {
+	rules := []PolicyRule{
+		matchAllRule(defaultTier, 5, "z-policy", 0, api.Allow),
+		matchAllRuleInTier("security", 10, 20, "b-policy", 0, api.Allow),
+		matchAllRuleInTier("security", 10, 10, "a-policy", 0, api.Allow),
+	}
+	sortPolicyRules(rules)
+
+	want := []string{"a-policy", "b-policy", "z-policy"}
+	for i, name := range want {
+		if rules[i].PolicyName != name {
+			t.Errorf("rule %d: expected policy %s, got %s", i, name, rules[i].PolicyName)
+		}
+	}
+}
+
+func TestSortPolicyRulesUsesTierOrderNotTierName(t *testing.T) {
+	// A tier whose name sorts alphabetically last can still evaluate
+	// first, if its Tier resource's Spec.Order says so -- tier
+	// evaluation order comes from that field, not the tier's name.
+	rules := []PolicyRule{
+		matchAllRuleInTier("aaa-low-priority", 100, 0, "low-priority-policy", 0, api.Allow),
+		matchAllRuleInTier("zzz-high-priority", 1, 0, "high-priority-policy", 0, api.Deny),
+	}
+	sortPolicyRules(rules)
+
+	want := []string{"high-priority-policy", "low-priority-policy"}
+	for i, name := range want {
+		if rules[i].PolicyName != name {
+			t.Errorf("rule %d: expected policy %s, got %s", i, name, rules[i].PolicyName)
+		}
+	}
+}
+
+func TestSortPolicyRulesDefaultTierAlwaysLast(t *testing.T) {
+	// Even a default tier "claiming" a very low Spec.Order (which isn't
+	// how Calico's Tier resource works for the implicit default tier, but
+	// exercises the worst case) must still evaluate after every other
+	// tier: matchAllRule always attaches math.Inf(1) for defaultTier.
+	rules := []PolicyRule{
+		matchAllRule(defaultTier, 0, "default-policy", 0, api.Deny),
+		matchAllRuleInTier("security", 1000, 0, "security-policy", 0, api.Allow),
+	}
+	sortPolicyRules(rules)
+
+	want := []string{"security-policy", "default-policy"}
+	for i, name := range want {
+		if rules[i].PolicyName != name {
+			t.Errorf("rule %d: expected policy %s, got %s", i, name, rules[i].PolicyName)
+		}
+	}
+}
@@ -0,0 +1,501 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"sync/atomic"
+
+	api "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	"github.com/projectcalico/libcalico-go/lib/clientv3"
+	"github.com/projectcalico/libcalico-go/lib/options"
+	"github.com/projectcalico/libcalico-go/lib/selector"
+
+	log "github.com/sirupsen/logrus"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// CalicoQuery answers the questions auth_server.Check needs answered on
+// every request.  Implementations are expected to serve both methods
+// entirely from in-memory state; neither should block on the Calico or k8s
+// API.
+type CalicoQuery interface {
+	// GetEndpointFromContainer resolves a container ID to the name and
+	// namespace of the WorkloadEndpoint running on this node.
+	GetEndpointFromContainer(containerID, nodeName string) (name, namespace string, err error)
+
+	// GetPolicies returns the precomputed, tier- and order-sorted rule
+	// set that applies to the named endpoint.
+	GetPolicies(name, namespace string) ([]PolicyRule, error)
+
+	// Ready reports whether the initial list of every watched resource
+	// has completed, i.e. whether the cache can be trusted to answer
+	// queries.
+	Ready() bool
+}
+
+// reconcileQueueLen is not applied to calicoQuery.queue: that workqueue
+// has no length limit. It does deduplicate keys, so it holds at most one
+// entry per local endpoint however many events arrive for it.
+const reconcileQueueLen = 4096
+
+// calicoQuery is the informer-backed CalicoQuery.  It runs a
+// reflector/delta-FIFO/indexer per watched resource kind and keeps an
+// endpointCache of precomputed rule sets up to date as events arrive.
+type calicoQuery struct {
+	client    clientv3.Interface
+	k8sClient kubernetes.Interface
+
+	// nodeName scopes every watch this query starts to the endpoints and
+	// pods local to this node -- the cache only ever needs to answer
+	// Check() for containers running here, and caching the whole
+	// cluster's WorkloadEndpoints/Pods on every node wastes memory and
+	// rebuild work without ever being consulted for another node's
+	// traffic.
+	nodeName string
+
+	cache *endpointCache
+
+	policies       cache.Indexer
+	globalPolicies cache.Indexer
+	endpoints      cache.Indexer
+	tiers          cache.Indexer
+	pods           cache.Indexer
+	serviceAccts   cache.Indexer
+	namespaces     cache.Indexer
+
+	controllers []cache.Controller
+
+	// queue carries endpoint keys that need their rule set recomputed.
+	// Using a rate limiting queue (rather than recomputing inline in the
+	// watch handler) means a storm of policy or pod events coalesces into
+	// one recompute per affected endpoint instead of one per event.
+	queue workqueue.RateLimitingInterface
+
+	synced int32 // atomic bool, set once all informers have completed their initial sync.
+
+	stopCh chan struct{}
+}
+
+func NewCalicoQuery(c clientv3.Interface, k8sClient kubernetes.Interface, nodeName string) *calicoQuery {
+	q := &calicoQuery{
+		client:    c,
+		k8sClient: k8sClient,
+		nodeName:  nodeName,
+		cache:     newEndpointCache(),
+		queue:     workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "app-policy-endpoints"),
+		stopCh:    make(chan struct{}),
+	}
+	q.policies = q.addInformer(policyListWatch(c), &api.NetworkPolicy{})
+	q.globalPolicies = q.addInformer(globalPolicyListWatch(c), &api.GlobalNetworkPolicy{})
+	q.endpoints = q.addInformer(endpointListWatch(c, nodeName), &api.WorkloadEndpoint{})
+	q.tiers = q.addInformer(tierListWatch(c), &api.Tier{})
+	q.pods = q.addInformer(podListWatch(k8sClient, nodeName), &corev1.Pod{})
+	q.serviceAccts = q.addInformer(serviceAccountListWatch(k8sClient), &corev1.ServiceAccount{})
+	q.namespaces = q.addInformer(namespaceListWatch(k8sClient), &corev1.Namespace{})
+
+	go q.runWorker()
+	for _, ctrl := range q.controllers {
+		go ctrl.Run(q.stopCh)
+	}
+	go q.waitForSync()
+	return q
+}
+
+// addInformer wires up a cache.NewIndexerInformer for one resource kind,
+// enqueuing the affected endpoint(s) whenever that kind changes, and
+// appends its controller to q.controllers so NewCalicoQuery can start and
+// sync it alongside the rest.
+func (q *calicoQuery) addInformer(lw cache.ListerWatcher, objType runtime.Object) cache.Indexer {
+	indexer, controller := cache.NewIndexerInformer(lw, objType, 0, cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { q.onResourceEvent(obj) },
+		UpdateFunc: func(_, obj interface{}) { q.onResourceEvent(obj) },
+		DeleteFunc: func(obj interface{}) { q.onResourceDelete(obj) },
+	}, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	q.controllers = append(q.controllers, controller)
+	return indexer
+}
+
+// onResourceEvent enqueues every endpoint potentially affected by a change
+// to the given object. A change to a single WorkloadEndpoint only enqueues
+// that one; a Pod event only updates the container-ID index (it can't
+// change which rules apply, so it never triggers a recompute); a Tier event
+// changes every rule's relative order without changing which rules apply,
+// so it rebuilds the tier-order cache and then recomputes every endpoint;
+// anything else (policy, service account, namespace) can affect many
+// endpoints' selector evaluation, so we re-walk the endpoint indexer too.
+func (q *calicoQuery) onResourceEvent(obj interface{}) {
+	switch o := obj.(type) {
+	case *api.WorkloadEndpoint:
+		q.queue.Add(endpointKey{Namespace: o.Namespace, Name: o.Name})
+	case *corev1.Pod:
+		q.onPodEvent(o)
+	case *api.Tier:
+		q.rebuildTierOrder()
+		q.recomputeAll()
+	default:
+		q.recomputeAll()
+	}
+}
+
+// onResourceDelete handles the cases where losing an object, rather than
+// just changing it, means something needs to be cleaned up immediately
+// instead of waiting on a recompute: a deleted pod's container-ID entry has
+// to go even though the pod itself never touches the rule set.
+func (q *calicoQuery) onResourceDelete(obj interface{}) {
+	if pod, ok := obj.(*corev1.Pod); ok {
+		q.cache.deletePod(endpointKey{Namespace: pod.Namespace, Name: pod.Name})
+		return
+	}
+	q.onResourceEvent(obj)
+}
+
+// onPodEvent updates the container-ID index for the pod's endpoint, if it
+// has one. Pod events never enqueue a recompute: a pod's containers don't
+// affect which rules apply to its endpoint, only which container ID
+// currently maps to it.
+func (q *calicoQuery) onPodEvent(pod *corev1.Pod) {
+	podKey := endpointKey{Namespace: pod.Namespace, Name: pod.Name}
+	cid := podContainerID(pod)
+	if cid == "" {
+		q.cache.deletePod(podKey)
+		return
+	}
+	q.cache.setPodContainer(podKey, cid)
+}
+
+// podContainerID returns the first container ID recorded on the pod,
+// stripped of its runtime prefix (e.g. "docker://", "containerd://"), or ""
+// if the pod has no container statuses yet.
+func podContainerID(pod *corev1.Pod) string {
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.ContainerID == "" {
+			continue
+		}
+		if i := strings.Index(cs.ContainerID, "://"); i >= 0 {
+			return cs.ContainerID[i+3:]
+		}
+		return cs.ContainerID
+	}
+	return ""
+}
+
+// rebuildTierOrder rebuilds the cached tier name -> Spec.Order map from the
+// current contents of the Tier indexer. A nil Order sorts after every
+// explicitly ordered tier, mirroring how policyRules treats a nil policy
+// Order, and still ahead of the implicit default tier (see tierOrder).
+func (q *calicoQuery) rebuildTierOrder() {
+	order := make(map[string]float64)
+	for _, o := range q.tiers.List() {
+		tier := o.(*api.Tier)
+		if tier.Spec.Order != nil {
+			order[tier.Name] = *tier.Spec.Order
+		} else {
+			order[tier.Name] = math.MaxFloat64
+		}
+	}
+	q.cache.setTierOrder(order)
+}
+
+// tierOrder returns the evaluation order for a policy's tier: the implicit
+// default tier always sorts after every other tier, regardless of Order;
+// otherwise it's the matching Tier resource's Spec.Order if we've seen it,
+// or a value that sorts after every explicitly ordered tier (but still
+// ahead of default) if we haven't.
+func (q *calicoQuery) tierOrder(tier string) float64 {
+	if tier == "" || tier == defaultTier {
+		return math.Inf(1)
+	}
+	if o, ok := q.cache.getTierOrder(tier); ok {
+		return o
+	}
+	return math.MaxFloat64
+}
+
+// recomputeAll enqueues every known endpoint for recomputation, for changes
+// (policy, service account, namespace) that can affect selector evaluation
+// cluster-wide rather than for one specific endpoint.
+func (q *calicoQuery) recomputeAll() {
+	if q.endpoints == nil {
+		return
+	}
+	for _, o := range q.endpoints.List() {
+		wep := o.(*api.WorkloadEndpoint)
+		q.queue.Add(endpointKey{Namespace: wep.Namespace, Name: wep.Name})
+	}
+}
+
+func (q *calicoQuery) runWorker() {
+	for q.processNext() {
+	}
+}
+
+func (q *calicoQuery) processNext() bool {
+	item, shutdown := q.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer q.queue.Done(item)
+	key := item.(endpointKey)
+	if err := q.recompute(key); err != nil {
+		log.WithError(err).Warnf("Failed to recompute rules for endpoint %v, will retry.", key)
+		q.queue.AddRateLimited(key)
+		return true
+	}
+	q.queue.Forget(key)
+	return true
+}
+
+// recompute rebuilds the ordered rule program for a single endpoint from
+// the current contents of the policy and endpoint indexers.
+func (q *calicoQuery) recompute(key endpointKey) error {
+	obj, exists, err := q.endpoints.GetByKey(key.Namespace + "/" + key.Name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		q.cache.deleteEndpoint(key)
+		return nil
+	}
+	wep := obj.(*api.WorkloadEndpoint)
+	// The container ID index is keyed off the pod, not the endpoint: it's
+	// populated from Pod events (see onPodEvent) and joined here by pod
+	// name/namespace, since WorkloadEndpoint doesn't carry a live
+	// container ID of its own.
+	podKey := endpointKey{Namespace: wep.Namespace, Name: wep.Spec.Pod}
+
+	labels := wep.Labels
+	var rules []PolicyRule
+	for _, o := range q.policies.List() {
+		pol := o.(*api.NetworkPolicy)
+		if pol.Namespace != key.Namespace {
+			continue
+		}
+		if selectorMatches(pol.Spec.Selector, labels) {
+			tier := tierOrDefault(pol.Spec.Tier)
+			rules = append(rules, policyRules(pol.Namespace, pol.Name, tier, q.tierOrder(tier), pol.Spec.Order, pol.Spec.Ingress, pol.Annotations)...)
+		}
+	}
+	for _, o := range q.globalPolicies.List() {
+		pol := o.(*api.GlobalNetworkPolicy)
+		if selectorMatches(pol.Spec.Selector, labels) {
+			tier := tierOrDefault(pol.Spec.Tier)
+			rules = append(rules, policyRules("", pol.Name, tier, q.tierOrder(tier), pol.Spec.Order, pol.Spec.Ingress, pol.Annotations)...)
+		}
+	}
+	sortPolicyRules(rules)
+	q.cache.setEndpoint(key, podKey, rules)
+	return nil
+}
+
+// tierOrDefault returns tier, or the implicit default tier's name if tier
+// is empty, matching how Calico treats a policy that doesn't set Spec.Tier.
+func tierOrDefault(tier string) string {
+	if tier == "" {
+		return defaultTier
+	}
+	return tier
+}
+
+// policyRules wraps a policy's ingress rules as PolicyRules carrying the
+// tier/order/identity sortPolicyRules and checkPolicies need. tierOrder is
+// the evaluating Tier resource's Spec.Order (see calicoQuery.tierOrder). A
+// nil policy Order sorts after every explicit order, matching Calico's
+// "policies with no order evaluate last" behaviour. annotations is the
+// policy's own annotations, parsed for the per-rule HTTPMatch constraints
+// rule.HTTP can't carry yet (see httpMatchAnnotation).
+func policyRules(namespace, name, tier string, tierOrder float64, order *float64, ingress []api.Rule, annotations map[string]string) []PolicyRule {
+	o := math.MaxFloat64
+	if order != nil {
+		o = *order
+	}
+	httpMatches := parseHTTPMatches(annotations)
+	out := make([]PolicyRule, len(ingress))
+	for i, rule := range ingress {
+		out[i] = PolicyRule{
+			Tier:            tier,
+			TierOrder:       tierOrder,
+			Order:           o,
+			PolicyNamespace: namespace,
+			PolicyName:      name,
+			RuleIndex:       i,
+			Rule:            rule,
+			HTTPMatch:       httpMatchForRule(httpMatches, i),
+		}
+	}
+	return out
+}
+
+func selectorMatches(selStr string, labels map[string]string) bool {
+	if selStr == "" {
+		return true
+	}
+	sel, err := selector.Parse(selStr)
+	if err != nil {
+		log.Warnf("Could not parse policy selector %v, %v", selStr, err)
+		return false
+	}
+	return sel.Evaluate(labels)
+}
+
+func (q *calicoQuery) waitForSync() {
+	syncFns := make([]cache.InformerSynced, 0, len(q.controllers))
+	for _, ctrl := range q.controllers {
+		syncFns = append(syncFns, ctrl.HasSynced)
+	}
+	if !cache.WaitForCacheSync(q.stopCh, syncFns...) {
+		log.Error("Caches never synced; Check() will keep returning UNAVAILABLE.")
+		return
+	}
+	atomic.StoreInt32(&q.synced, 1)
+	log.Info("Policy cache synced; serving Check() from memory.")
+}
+
+func (q *calicoQuery) Ready() bool {
+	return atomic.LoadInt32(&q.synced) == 1
+}
+
+func (q *calicoQuery) GetEndpointFromContainer(containerID, nodeName string) (name, namespace string, err error) {
+	if nodeName != q.nodeName {
+		// The cache only ever holds endpoints local to q.nodeName (see
+		// endpointListWatch/podListWatch), so a request for any other
+		// node can never be answered from it.
+		return "", "", fmt.Errorf("cannot resolve container %s for node %s from %s's cache", containerID, nodeName, q.nodeName)
+	}
+	key, ok := q.cache.getContainer(containerID)
+	if !ok {
+		return "", "", fmt.Errorf("no endpoint cached for container %s", containerID)
+	}
+	return key.Name, key.Namespace, nil
+}
+
+func (q *calicoQuery) GetPolicies(name, namespace string) ([]PolicyRule, error) {
+	rules, ok := q.cache.getRules(endpointKey{Namespace: namespace, Name: name})
+	if !ok {
+		return nil, fmt.Errorf("no rules cached for endpoint %s/%s", namespace, name)
+	}
+	return rules, nil
+}
+
+func (q *calicoQuery) Stop() {
+	close(q.stopCh)
+	q.queue.ShutDown()
+}
+
+// The ListWatch constructors below sort the watched resources by which
+// client serves them: Calico resources (policies, global policies,
+// endpoints, tiers) through the clientv3 backend, everything else through the
+// plain k8s clientset. Resync is left to the watch stream; we pass
+// options.ListOptions{} / metav1.ListOptions{} unmodified since we want
+// every object of the kind, not a filtered subset -- except for Pods and
+// WorkloadEndpoints, which are scoped to this node: see endpointListWatch
+// and podListWatch.
+
+func policyListWatch(c clientv3.Interface) cache.ListerWatcher {
+	return &cache.ListWatch{
+		ListFunc: func(_ metav1.ListOptions) (runtime.Object, error) {
+			return c.NetworkPolicies().List(context.Background(), options.ListOptions{})
+		},
+		WatchFunc: func(_ metav1.ListOptions) (watch.Interface, error) {
+			return c.NetworkPolicies().Watch(context.Background(), options.ListOptions{})
+		},
+	}
+}
+
+func globalPolicyListWatch(c clientv3.Interface) cache.ListerWatcher {
+	return &cache.ListWatch{
+		ListFunc: func(_ metav1.ListOptions) (runtime.Object, error) {
+			return c.GlobalNetworkPolicies().List(context.Background(), options.ListOptions{})
+		},
+		WatchFunc: func(_ metav1.ListOptions) (watch.Interface, error) {
+			return c.GlobalNetworkPolicies().Watch(context.Background(), options.ListOptions{})
+		},
+	}
+}
+
+// endpointListWatch watches WorkloadEndpoints local to nodeName. clientv3's
+// ListOptions has no field selector for Spec.Node, so filtering happens on
+// our side of the client instead of the server's: the List result has
+// every other node's endpoints stripped out before the indexer ever sees
+// them, and the watch is wrapped the same way so an event for another
+// node's endpoint never reaches onResourceEvent.
+func endpointListWatch(c clientv3.Interface, nodeName string) cache.ListerWatcher {
+	onThisNode := func(obj runtime.Object) bool {
+		wep, ok := obj.(*api.WorkloadEndpoint)
+		return ok && wep.Spec.Node == nodeName
+	}
+	return &cache.ListWatch{
+		ListFunc: func(_ metav1.ListOptions) (runtime.Object, error) {
+			list, err := c.WorkloadEndpoints().List(context.Background(), options.ListOptions{})
+			if err != nil {
+				return nil, err
+			}
+			kept := list.Items[:0]
+			for _, wep := range list.Items {
+				if wep.Spec.Node == nodeName {
+					kept = append(kept, wep)
+				}
+			}
+			list.Items = kept
+			return list, nil
+		},
+		WatchFunc: func(_ metav1.ListOptions) (watch.Interface, error) {
+			w, err := c.WorkloadEndpoints().Watch(context.Background(), options.ListOptions{})
+			if err != nil {
+				return nil, err
+			}
+			return watch.Filter(w, func(e watch.Event) (watch.Event, bool) {
+				return e, onThisNode(e.Object)
+			}), nil
+		},
+	}
+}
+
+func tierListWatch(c clientv3.Interface) cache.ListerWatcher {
+	return &cache.ListWatch{
+		ListFunc: func(_ metav1.ListOptions) (runtime.Object, error) {
+			return c.Tiers().List(context.Background(), options.ListOptions{})
+		},
+		WatchFunc: func(_ metav1.ListOptions) (watch.Interface, error) {
+			return c.Tiers().Watch(context.Background(), options.ListOptions{})
+		},
+	}
+}
+
+// podListWatch watches only the Pods scheduled to nodeName: the API server
+// supports a field selector on spec.nodeName for Pods, so (unlike
+// WorkloadEndpoints) this can be filtered server-side.
+func podListWatch(k8sClient kubernetes.Interface, nodeName string) cache.ListerWatcher {
+	return cache.NewListWatchFromClient(k8sClient.CoreV1().RESTClient(), "pods", metav1.NamespaceAll, fields.OneTermEqualSelector("spec.nodeName", nodeName))
+}
+
+func serviceAccountListWatch(k8sClient kubernetes.Interface) cache.ListerWatcher {
+	return cache.NewListWatchFromClient(k8sClient.CoreV1().RESTClient(), "serviceaccounts", metav1.NamespaceAll, fields.Everything())
+}
+
+func namespaceListWatch(k8sClient kubernetes.Interface) cache.ListerWatcher {
+	return cache.NewListWatchFromClient(k8sClient.CoreV1().RESTClient(), "namespaces", metav1.NamespaceAll, fields.Everything())
+}
@@ -15,6 +15,8 @@
 package server
 
 import (
+	"time"
+
 	authz "github.com/envoyproxy/data-plane-api/api/auth"
 
 	"github.com/projectcalico/libcalico-go/lib/clientv3"
@@ -32,12 +34,14 @@ import (
 
 type (
 	auth_server struct {
-		NodeName   string
-		Query CalicoQuery
+		NodeName  string
+		Query     CalicoQuery
+		Audit     AuditSink
+		AuditOnly bool
 	}
 )
 
-func NewServer(config apiconfig.CalicoAPIConfig, nodeName string) (*auth_server, error) {
+func NewServer(config apiconfig.CalicoAPIConfig, nodeName string, audit AuditSink, auditOnly bool) (*auth_server, error) {
 	c, err := clientv3.New(config)
 	log.Debug("Created Calico Client.")
 	if err != nil {
@@ -49,34 +53,91 @@ func NewServer(config apiconfig.CalicoAPIConfig, nodeName string) (*auth_server,
 	if err != nil {
 		return nil, err
 	}
-	q := NewCalicoQuery(c, clientset)
-	return &auth_server{nodeName, q}, nil
+	q := NewCalicoQuery(c, clientset, nodeName)
+	if audit == nil {
+		audit = noopAuditSink{}
+	}
+	return &auth_server{nodeName, q, audit, auditOnly}, nil
 }
 
 func (as *auth_server) Check(ctx context.Context, req *authz.CheckRequest) (*authz.CheckResponse, error) {
 	log.Debugf("Check(%v, %v)", ctx, req)
-	resp := authz.CheckResponse{Status: &status.Status{Code: code.Code_value["INTERNAL"]}}
+	start := time.Now()
+	resp := authz.CheckResponse{}
+	dec := decisionFromRequest(req)
+	defer func() {
+		dec.Timestamp = start
+		dec.Latency = time.Since(start)
+		as.Audit.Report(dec)
+	}()
+
+	// finish is the single exit point for Check(): it records the real
+	// outcome on dec for the audit sink, then -- in --audit-only mode --
+	// overrides the response itself to OK. Every return path, including
+	// the error ones below, goes through it so audit-only's "always let
+	// the request through" contract with Envoy holds even when the cache
+	// isn't synced yet or a lookup fails, not just when checkPolicies runs.
+	finish := func(st status.Status, matched *PolicyRule) *authz.CheckResponse {
+		if matched != nil {
+			dec.PolicyNamespace = matched.PolicyNamespace
+			dec.PolicyName = matched.PolicyName
+			dec.RuleIndex = matched.RuleIndex
+		}
+		dec.Allowed = st.GetCode() == code.Code_value["OK"]
+		if as.AuditOnly && st.GetCode() != code.Code_value["OK"] {
+			log.WithFields(log.Fields{
+				"code":   st.GetCode(),
+				"policy": matched,
+			}).Info("audit-only mode: would not have allowed, allowing anyway.")
+			st = status.Status{Code: code.Code_value["OK"]}
+		}
+		resp.Status = &st
+		return &resp
+	}
+
+	if !as.Query.Ready() {
+		log.Debug("Policy cache not yet synced, returning UNAVAILABLE.")
+		return finish(status.Status{Code: code.Code_value["UNAVAILABLE"]}, nil), nil
+	}
 	cid, err := getContainerFromContext(ctx)
 	if err != nil {
 		log.Errorf("Failed to get container ID. %v", err)
-		return &resp, nil
+		return finish(status.Status{Code: code.Code_value["INTERNAL"]}, nil), nil
 	}
+	// GetEndpointFromContainer and GetPolicies are pure in-memory lookups
+	// against the cache query.go keeps in sync via watch events; neither
+	// makes a call to the Calico or k8s API on this path.
 	name, namespace, err := as.Query.GetEndpointFromContainer(cid, as.NodeName)
 	if err != nil {
 		log.Errorf("Failed to get endpoint for container %v. %v", cid, err)
+		return finish(status.Status{Code: code.Code_value["INTERNAL"]}, nil), nil
 	}
 	policies, err := as.Query.GetPolicies(name, namespace)
 	if err != nil {
 		log.Errorf("Failed to get policies. %v", err)
-		return &resp, nil
+		return finish(status.Status{Code: code.Code_value["INTERNAL"]}, nil), nil
 	}
-	st := checkPolicies(policies, req)
-	resp.Status = &st
+	st, matched := checkPolicies(policies, req)
+	result := finish(st, matched)
 	log.WithFields(log.Fields{
 		"Request":  req,
-		"Response": resp,
+		"Response": result,
 	}).Info("Check complete")
-	return &resp, nil
+	return result, nil
+}
+
+// decisionFromRequest pre-populates the parts of a Decision that come
+// straight off the request, before Check() knows the outcome or which
+// policy/rule (if any) decided it.
+func decisionFromRequest(req *authz.CheckRequest) Decision {
+	attr := req.GetAttributes()
+	httpReq := attr.GetRequest().GetHttp()
+	return Decision{
+		SourceSPIFFEID: attr.GetSource().GetPrincipal(),
+		HTTPMethod:     httpReq.GetMethod(),
+		HTTPPath:       httpReq.GetPath(),
+		HTTPHost:       httpReq.GetHost(),
+	}
 }
 
 // Modified from libcalico-go/lib/backend/k8s/k8s.go to return bare clientset.